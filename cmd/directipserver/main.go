@@ -2,12 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	yaml "gopkg.in/yaml.v2"
 	v1 "k8s.io/api/core/v1"
@@ -16,6 +25,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
+	"github.com/SnapITHD/Pinpoint-DirectIP/metrics"
 	"github.com/SnapITHD/Pinpoint-DirectIP/mux"
 	"github.com/SnapITHD/Pinpoint-DirectIP/sbd"
 )
@@ -41,7 +51,15 @@ func main() {
 	loglevel := flag.String("loglevel", "info", "the loglevel, debug|info|warn|error|crit")
 	logformat := flag.String("logformat", "json", "the logformat, fmt|json|term")
 	workers := flag.Int("workers", 5, "the number of workers")
+	queuesize := flag.Int("queuesize", 1000, "how many messages to buffer in memory awaiting delivery to targets")
+	queuespilldir := flag.String("queuespilldir", "", "directory to spill queued messages to once queuesize is exceeded; empty rejects overflow, so it is not acknowledged")
 	useproxyprotocol := flag.Bool("proxyprotocol", false, "use the proxyprotocol on the listening socket")
+	trustedproxies := flag.String("trustedproxies", "", "comma separated list of CIDRs allowed to present a proxyprotocol header; empty trusts any peer")
+	shutdowntimeout := flag.Duration("shutdowntimeout", 15*time.Second, "how long to wait for in-flight connections to drain during shutdown")
+	tlscert := flag.String("tlscert", "", "path to a TLS certificate; enables TLS on the listening socket")
+	tlskey := flag.String("tlskey", "", "path to the TLS certificate's private key")
+	tlsclientca := flag.String("tlsclientca", "", "path to a PEM file of CAs to verify client certificates against; enables mTLS")
+	tlsrequireclientcert := flag.Bool("tlsrequireclientcert", false, "reject TLS connections that do not present a client certificate verified by tlsclientca")
 
 	flag.Parse()
 
@@ -58,7 +76,16 @@ func main() {
 	}
 	log.Info().Msgf("start service: revision %s, builddate %s, listen %s ...", revision, builddate, listen)
 	//log.Info("start service", "revision", revision, "builddate", builddate, "listen", listen)
-	distribution = mux.New(*workers, log)
+
+	registry := prometheus.NewRegistry()
+	collectors := metrics.New(registry)
+
+	var err error
+	distribution, err = mux.New(*workers, log, mux.Options{QueueSize: *queuesize, QueueSpillDir: *queuespilldir, Metrics: collectors})
+	if err != nil {
+		log.Panic().AnErr("error", err).Msg("cannot create distributor")
+		os.Exit(1)
+	}
 	if *config != "" {
 		cfg, err := os.Open(*config)
 		if err != nil {
@@ -80,7 +107,9 @@ func main() {
 		log.Info().Any("targets", targets).Msg("change configuration")
 	}
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	client, err := rest.InClusterConfig()
 	if err != nil {
 		log.Info().Msg("no incluster config, assume standalone mode")
@@ -89,14 +118,115 @@ func main() {
 		go watchServices(ctx, log, client, distribution)
 	}
 
-	go runHealth(*health)
-	sbd.NewService(log, listen, sbd.Logger(log, distribution), *useproxyprotocol)
+	go runHealth(*health, registry)
+
+	proxies, err := parseTrustedProxies(*trustedproxies)
+	if err != nil {
+		log.Panic().AnErr("error", err).Msg("cannot parse trustedproxies")
+		os.Exit(1)
+	}
+
+	tlsConfig, err := loadTLSConfig(*tlscert, *tlskey, *tlsclientca, *tlsrequireclientcert)
+	if err != nil {
+		log.Panic().AnErr("error", err).Msg("cannot load TLS configuration")
+		os.Exit(1)
+	}
+
+	svc := sbd.New(log, listen, sbd.Logger(log, sbd.Metrics(registry, distribution)), sbd.ServiceOptions{
+		ProxyProtocol:   *useproxyprotocol,
+		TrustedProxies:  proxies,
+		ShutdownTimeout: *shutdowntimeout,
+		Metrics:         collectors,
+		TLSConfig:       tlsConfig,
+	})
+	if err := svc.Run(ctx); err != nil {
+		log.Error().AnErr("error", err).Msg("service stopped")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdowntimeout)
+	defer cancel()
+	if err := svc.Shutdown(shutdownCtx); err != nil {
+		log.Error().AnErr("error", err).Msg("shutdown did not complete cleanly")
+	}
+
+	queueCtx, queueCancel := context.WithTimeout(context.Background(), *shutdowntimeout)
+	defer queueCancel()
+	distribution.Close(queueCtx)
+}
+
+// parseTrustedProxies parses a comma separated list of CIDRs. A bare IP is
+// treated as a /32 (or /128 for IPv6). An empty string returns no networks,
+// meaning the proxyprotocol header is trusted from any peer.
+func parseTrustedProxies(s string) ([]net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var nets []net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", part)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			part = fmt.Sprintf("%s/%d", part, bits)
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy network %q: %v", part, err)
+		}
+		nets = append(nets, *n)
+	}
+	return nets, nil
+}
+
+// loadTLSConfig builds the *tls.Config for the listening socket from the
+// given flags. It returns nil, nil when certFile is empty, meaning TLS is
+// disabled. When clientCAFile is set, presented client certificates are
+// verified against it (mTLS); requireClientCert additionally rejects
+// connections that do not present one.
+func loadTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read TLS client CA file %q: %v", clientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS client CA file %q", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
 }
 
-func runHealth(health string) {
-	http.ListenAndServe(health, http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+func runHealth(health string, registry *prometheus.Registry) {
+	mx := http.NewServeMux()
+	mx.HandleFunc("/", func(rw http.ResponseWriter, rq *http.Request) {
 		fmt.Fprintf(rw, "OK")
-	}))
+	})
+	mx.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	http.ListenAndServe(health, mx)
 }
 
 func watchServices(ctx context.Context, log zerolog.Logger, client *rest.Config, s mux.Distributer) {
@@ -0,0 +1,93 @@
+// Package metrics bundles the Prometheus collectors this service exposes
+// for operational observability, so sbd.Service and mux.Distributer can be
+// instrumented by passing a single *Collectors around instead of each
+// wiring its own metrics. Create one with New and expose it on an HTTP
+// handler with promhttp.HandlerFor.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Collectors bundles the Prometheus collectors for connection- and
+// dispatch-level observability. Message-level metrics (sbd_messages_total,
+// sbd_message_bytes) are instead registered by the sbd.Metrics middleware,
+// which mirrors sbd.Logger and is composed the same way.
+type Collectors struct {
+	// ConnectionsTotal counts every accepted SBD connection.
+	ConnectionsTotal prometheus.Counter
+	// ConnectionDuration observes how long handling a single SBD
+	// connection takes, from accept to response written.
+	ConnectionDuration prometheus.Histogram
+	// DecodeErrorsTotal counts SBD packets that failed to decode.
+	DecodeErrorsTotal prometheus.Counter
+
+	// DispatchTotal counts delivery attempts to a mux target, labeled by
+	// target ID and outcome ("success" or "failure").
+	DispatchTotal *prometheus.CounterVec
+	// DispatchDuration observes the duration of a single delivery
+	// attempt to a mux target.
+	DispatchDuration *prometheus.HistogramVec
+	// QueueDepth reports how many messages are currently buffered in the
+	// mux delivery queue, awaiting dispatch.
+	QueueDepth prometheus.Gauge
+	// TargetMatchesTotal counts messages whose IMEI matched a target's
+	// pattern, labeled by target ID.
+	TargetMatchesTotal *prometheus.CounterVec
+}
+
+// New creates and registers every collector with reg. Use
+// prometheus.NewRegistry for an isolated registry, or
+// prometheus.DefaultRegisterer to use the global one.
+func New(reg prometheus.Registerer) *Collectors {
+	c := &Collectors{
+		ConnectionsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sbd_connections_total",
+			Help: "Total number of accepted SBD connections.",
+		}),
+		ConnectionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "sbd_connection_duration_seconds",
+			Help: "Duration of handling a single SBD connection, from accept to response written.",
+		}),
+		DecodeErrorsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sbd_decode_errors_total",
+			Help: "Total number of SBD packets that failed to decode.",
+		}),
+		DispatchTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mux_dispatch_total",
+			Help: "Total number of target dispatch attempts, by target and outcome.",
+		}, []string{"target", "status"}),
+		DispatchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "mux_dispatch_duration_seconds",
+			Help: "Duration of a single target dispatch attempt.",
+		}, []string{"target"}),
+		QueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mux_queue_depth",
+			Help: "Number of messages currently buffered in the delivery queue.",
+		}),
+		TargetMatchesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mux_target_matches_total",
+			Help: "Total number of messages matched to a target's IMEI pattern.",
+		}, []string{"target"}),
+	}
+	reg.MustRegister(
+		c.ConnectionsTotal,
+		c.ConnectionDuration,
+		c.DecodeErrorsTotal,
+		c.DispatchTotal,
+		c.DispatchDuration,
+		c.QueueDepth,
+		c.TargetMatchesTotal,
+	)
+	return c
+}
+
+// IMEIClass returns a low-cardinality label value for an IMEI: its Type
+// Allocation Code (the first 8 digits), which identifies the device model
+// without exposing the individual device identity as a raw, unbounded
+// label value.
+func IMEIClass(imei string) string {
+	const tacLength = 8
+	if len(imei) < tacLength {
+		return imei
+	}
+	return imei[:tacLength]
+}
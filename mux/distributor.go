@@ -1,25 +1,29 @@
-// Package mux provides a service to split incoming directip messages to backend HTTP
+// Package mux provides a service to split incoming directip messages to backend
 // services. The mux stores a list of targets and each target has a pattern for an IMEI.
 // If the IMEI of the incoming message matches with the given regurlar expression, the mux
-// will send an HTTP request with a JSON message to the configured backend.
+// will dispatch the message to the configured backend, through a Publisher resolved from
+// the target's Backend URL scheme (http(s):// for webhooks, nats://, mqtt://, ...).
 //
 // Every target service will receive a sbd.InformationElements as a JSON representation in its
-// POST body. Please take into account that this service and package does not parse the payload
+// payload. Please take into account that this service and package does not parse the payload
 // which is of type []byte. Many devices use the payload to transfer specific types of data. Your
 // backend service has to know how to handle these types.
 package mux
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"hash/fnv"
+	"net/url"
+	"os"
 	"regexp"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 
+	"github.com/SnapITHD/Pinpoint-DirectIP/metrics"
 	"github.com/SnapITHD/Pinpoint-DirectIP/sbd"
 )
 
@@ -30,8 +34,28 @@ type Target struct {
 	Backend     string            `yaml:"backend"`
 	SkipTLS     bool              `yaml:"skiptls,omitempty"`
 	Header      map[string]string `yaml:"header"`
+	// Topic is the subject/topic template used by pub/sub backends (NATS,
+	// MQTT, ...), e.g. "sbd/{imei}/data". It is ignored by HTTP backends.
+	// The placeholders {imei}, {momsn} and {cdrRef} are substituted from
+	// the incoming message. If empty, it defaults to the Target ID, and
+	// then to the IMEI.
+	Topic string `yaml:"topic,omitempty"`
+	// Username and Password authenticate against the broker, where
+	// supported by the backend (NATS, MQTT).
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// QoS is the MQTT quality of service level (0, 1 or 2). Ignored by
+	// other backends.
+	QoS byte `yaml:"qos,omitempty"`
+	// Retry configures how failed deliveries to this target are retried.
+	Retry RetryPolicy `yaml:"retry,omitempty"`
+	// DeadLetter receives the original payload, plus failure metadata,
+	// once Retry is exhausted. It may be a URL (reusing the same
+	// Publisher backends as Backend) or a plain file path, appended to as
+	// newline delimited JSON.
+	DeadLetter string `yaml:"deadletter,omitempty"`
+
 	imeipattern *regexp.Regexp
-	client      *http.Client
 }
 
 // Targets is a list of Target's
@@ -43,7 +67,14 @@ type Distributer interface {
 	WithTargets(targets Targets) error
 	Targets() Targets
 	Handle(data *sbd.InformationBucket) error
-	Close()
+	HandleContext(ctx context.Context, data *sbd.InformationBucket) error
+	// Close stops accepting new messages and waits for the delivery queue
+	// to drain - flushing whatever was already durably enqueued - up to
+	// ctx's deadline, before releasing publishers. Since Enqueue already
+	// acknowledges the message, whatever is still buffered in memory when
+	// ctx is done, or when Close is skipped, is lost; spilled messages stay
+	// on disk for the next run.
+	Close(ctx context.Context)
 }
 
 type distributer struct {
@@ -51,26 +82,67 @@ type distributer struct {
 	targets       []Target
 	sbdChannel    chan *sbdMessage
 	configChannel chan Targets
+	queue         *Queue
+	stopQueue     context.CancelFunc
+	metrics       *metrics.Collectors
+
+	mu         sync.Mutex
+	publishers map[string]Publisher
 }
 
 type sbdMessage struct {
+	ctx           context.Context
 	data          sbd.InformationBucket
 	returnedError chan error
 }
 
-// New creates a new Distributor with the given number of workers
-func New(numworkers int, log zerolog.Logger) Distributer {
+// Options configures the delivery queue a Distributer uses to decouple
+// message acknowledgement from delivery.
+type Options struct {
+	// QueueSize bounds how many messages are buffered in memory awaiting
+	// delivery. Defaults to 1000 when zero.
+	QueueSize int
+	// QueueSpillDir persists messages that overflow QueueSize to disk, so
+	// a slow or flapping backend degrades gracefully instead of blocking
+	// acknowledgement or growing memory without bound. Leave empty to
+	// reject overflow instead: the message is then not acknowledged.
+	QueueSpillDir string
+	// Metrics, if set, records dispatch- and queue-level Prometheus
+	// metrics: mux_dispatch_total, mux_dispatch_duration_seconds,
+	// mux_queue_depth and mux_target_matches_total.
+	Metrics *metrics.Collectors
+}
+
+// New creates a new Distributor with the given number of workers.
+func New(numworkers int, log zerolog.Logger, opts Options) (Distributer, error) {
+	q, err := NewQueue(log, QueueOptions{Size: opts.QueueSize, SpillDir: opts.QueueSpillDir, Metrics: opts.Metrics})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create delivery queue: %v", err)
+	}
+
 	sc := make(chan *sbdMessage)
 	cc := make(chan Targets)
+	qctx, cancel := context.WithCancel(context.Background())
 	s := &distributer{
 		sbdChannel:    sc,
 		configChannel: cc,
 		Logger:        log,
+		publishers:    map[string]Publisher{},
+		queue:         q,
+		stopQueue:     cancel,
+		metrics:       opts.Metrics,
 	}
+
+	deliveryWorkers := numworkers
+	if deliveryWorkers <= 0 {
+		deliveryWorkers = 1
+	}
+	q.Drain(qctx, deliveryWorkers, s.deliverMessage)
+
 	for i := 0; i < numworkers; i++ {
 		go s.run(i)
 	}
-	return s
+	return s, nil
 }
 
 func (f *distributer) Targets() Targets {
@@ -79,41 +151,142 @@ func (f *distributer) Targets() Targets {
 
 func (f *distributer) WithTargets(targets Targets) error {
 	var ar Targets
+	keep := map[string]bool{}
 	for _, t := range targets {
 		p, err := regexp.Compile(t.IMEIPattern)
 		if err != nil {
 			return fmt.Errorf("cannot compile patter: %q: %v", t.IMEIPattern, err)
 		}
 		t.imeipattern = p
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: t.SkipTLS,
-			},
+
+		u, err := url.Parse(t.Backend)
+		if err != nil {
+			return fmt.Errorf("cannot parse backend %q: %v", t.Backend, err)
+		}
+
+		if _, err := f.publisherFor(u, t); err != nil {
+			return fmt.Errorf("cannot configure backend %q: %v", t.Backend, err)
+		}
+		keep[publisherKey(u, t)] = true
+
+		if t.DeadLetter != "" {
+			if du, err := url.Parse(t.DeadLetter); err == nil && du.Scheme != "" {
+				keep[publisherKey(du, f.deadLetterTarget(t, du))] = true
+			}
 		}
-		t.client = &http.Client{Transport: tr}
 
 		ar = append(ar, t)
 	}
+	f.closeStalePublishers(keep)
 	f.configChannel <- ar
 	return nil
 }
 
+// closeStalePublishers closes and forgets every cached Publisher whose key
+// is not in keep, the set of publisher keys the targets just passed to
+// WithTargets still need. Without this, a Target removed or changed by a
+// later WithTargets call - as cmd/directipserver's watchServices does
+// continuously for Kubernetes services - would leak its broker connection
+// forever.
+func (f *distributer) closeStalePublishers(keep map[string]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, p := range f.publishers {
+		if keep[key] {
+			continue
+		}
+		if err := p.Close(); err != nil {
+			f.Error().Str("broker", key).AnErr("error", err).Msg("cannot close stale publisher")
+		}
+		delete(f.publishers, key)
+	}
+}
+
+// publisherFor returns the shared Publisher for the endpoint addressed by u
+// (see publisherKey for what counts as "the same" endpoint), creating it via
+// the registered PublisherFactory on first use. Targets that share a broker
+// but differ in the config that affects the connection (credentials, QoS,
+// TLS verification) get their own Publisher instead of silently inheriting
+// whichever target happened to create the cached one first.
+func (f *distributer) publisherFor(u *url.URL, t Target) (Publisher, error) {
+	key := publisherKey(u, t)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if p, ok := f.publishers[key]; ok {
+		return p, nil
+	}
+	factory, err := publisherFactoryFor(u.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	p, err := factory(u, t, f.Logger)
+	if err != nil {
+		return nil, err
+	}
+	f.publishers[key] = p
+	return p, nil
+}
+
+// publisherKey identifies the Publisher a Target resolves to: scheme, host
+// (plus path for http/https, since httpPublisher dispatches to the exact
+// backend URL it was built with rather than a per-call topic - two targets
+// on the same host but a different path must not share one), and a hash of
+// the config fields that affect how the connection is made (credentials,
+// QoS, TLS verification). The credentials themselves are hashed rather than
+// embedded, since this key is also used as a log field.
+func publisherKey(u *url.URL, t Target) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%s|%d|%t", t.Username, t.Password, t.QoS, t.SkipTLS)
+	endpoint := u.Host
+	if u.Scheme == "http" || u.Scheme == "https" {
+		endpoint = u.Host + u.Path
+	}
+	return fmt.Sprintf("%s://%s#%x", u.Scheme, endpoint, h.Sum64())
+}
+
 func (f *distributer) Handle(data *sbd.InformationBucket) error {
-	return f.distribute(data)
+	return f.HandleContext(context.Background(), data)
 }
 
-func (f *distributer) distribute(data *sbd.InformationBucket) error {
-	msg := &sbdMessage{data: *data, returnedError: make(chan error)}
-	f.sbdChannel <- msg
-	rerr := <-msg.returnedError
-	close(msg.returnedError)
-	return rerr
+func (f *distributer) HandleContext(ctx context.Context, data *sbd.InformationBucket) error {
+	return f.distribute(ctx, data)
+}
+
+func (f *distributer) distribute(ctx context.Context, data *sbd.InformationBucket) error {
+	msg := &sbdMessage{ctx: ctx, data: *data, returnedError: make(chan error, 1)}
+	select {
+	case f.sbdChannel <- msg:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case rerr := <-msg.returnedError:
+		return rerr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (f *distributer) Close() {
+func (f *distributer) Close(ctx context.Context) {
 	f.Info().Msg("close distributor")
 	close(f.configChannel)
 	close(f.sbdChannel)
+
+	f.queue.Wait(ctx)
+	if err := ctx.Err(); err != nil {
+		f.Error().AnErr("error", err).Msg("distributor closed with messages still queued")
+	}
+	f.stopQueue()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, p := range f.publishers {
+		if err := p.Close(); err != nil {
+			f.Error().Str("broker", key).AnErr("error", err).Msg("cannot close publisher")
+		}
+	}
 }
 
 func (f *distributer) run(worker int) {
@@ -126,47 +299,190 @@ func (f *distributer) run(worker int) {
 			}
 			f.Info().Any("config", cfg).Int("worker", worker).Msgf("set config")
 			f.targets = cfg
-		case msg := <-f.sbdChannel:
+		case msg, more := <-f.sbdChannel:
+			if !more {
+				return
+			}
 			go f.handle(msg)
 		}
 	}
 }
 
+// handle matches the targets for the incoming message and durably enqueues
+// it for delivery. Once Enqueue succeeds, the message is considered handled
+// - the caller (ultimately sbd.Service) sends its acknowledgement - and the
+// actual delivery, with its retry policy, happens asynchronously off the
+// queue. This means a slow or flapping backend can no longer cause the
+// Iridium gateway to resend and duplicate messages.
 func (f *distributer) handle(m *sbdMessage) {
-	js, err := json.Marshal(m.data)
-	if err != nil {
-		m.returnedError <- err
-		return
-	}
 	imei := m.data.Header.GetIMEI()
+	var matched []Target
 	for _, t := range f.targets {
 		if t.imeipattern.MatchString(imei) {
-			rq, err := http.NewRequest(http.MethodPost, t.Backend, bytes.NewBuffer(js))
-			if err != nil {
-				f.Error().Str("error", err.Error()).Str("target", t.Backend).Msg("cannot create request")
-				m.returnedError <- err
-				return
-			}
-			rq.Header.Add("Content-Type", "application/json")
-			for k, v := range t.Header {
-				rq.Header.Add(k, v)
-			}
-			rsp, err := t.client.Do(rq)
-			if err != nil {
-				f.Error().Str("target", t.Backend).Str("error", err.Error()).Msg("cannot call webhook")
-				m.returnedError <- err
-				return
-			}
-			defer rsp.Body.Close()
-			content, _ := io.ReadAll(rsp.Body)
-			if rsp.StatusCode/100 == 2 {
-				f.Info().Str("target", t.Backend).Str("status", rsp.Status).Str("content", string(content)).Msg("data transmitted")
-			} else {
-				f.Error().Str("target", t.Backend).Str("status", rsp.Status).Str("content", string(content)).Msg("data not transmitted")
-				m.returnedError <- err
-				return
+			matched = append(matched, t)
+			if f.metrics != nil {
+				f.metrics.TargetMatchesTotal.WithLabelValues(targetLabel(t)).Inc()
 			}
 		}
 	}
+	if len(matched) == 0 {
+		m.returnedError <- nil
+		return
+	}
+	if err := f.queue.Enqueue(&m.data, matched); err != nil {
+		f.Error().AnErr("error", err).Msg("cannot enqueue message for delivery")
+		m.returnedError <- err
+		return
+	}
 	m.returnedError <- nil
 }
+
+// deliverMessage is called by the queue for every message it drains. It
+// delivers the message to each of its matched targets independently, so one
+// slow target does not delay delivery to the others.
+func (f *distributer) deliverMessage(ctx context.Context, m *queuedMessage) {
+	js, err := json.Marshal(m.Data)
+	if err != nil {
+		f.Error().AnErr("error", err).Msg("cannot marshal queued message")
+		return
+	}
+	imei := m.Data.Header.GetIMEI()
+	for _, t := range m.Targets {
+		f.deliverToTarget(ctx, t, &m.Data, js, imei)
+	}
+}
+
+// targetLabel returns the low-cardinality label value identifying t in
+// Prometheus metrics: its ID, falling back to its Backend URL when no ID is
+// configured.
+func targetLabel(t Target) string {
+	if t.ID != "" {
+		return t.ID
+	}
+	return t.Backend
+}
+
+// deliverToTarget publishes payload to t, retrying according to t.Retry,
+// and falls back to t.DeadLetter once the policy is exhausted.
+func (f *distributer) deliverToTarget(ctx context.Context, t Target, data *sbd.InformationBucket, payload []byte, imei string) {
+	u, err := url.Parse(t.Backend)
+	if err != nil {
+		f.Error().Str("target", t.Backend).AnErr("error", err).Msg("cannot parse backend")
+		return
+	}
+	p, err := f.publisherFor(u, t)
+	if err != nil {
+		f.Error().Str("target", t.Backend).AnErr("error", err).Msg("cannot resolve publisher")
+		return
+	}
+	topic := topicFor(t, data, imei)
+	policy := t.Retry.withDefaults()
+	label := targetLabel(t)
+
+	backoff := policy.InitialBackoff
+	var lastErr error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		pctx := ctx
+		var cancel context.CancelFunc
+		if policy.Timeout > 0 {
+			pctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		}
+		attemptStart := time.Now()
+		lastErr = p.Publish(pctx, topic, payload, t.Header)
+		if cancel != nil {
+			cancel()
+		}
+		if f.metrics != nil {
+			status := "success"
+			if lastErr != nil {
+				status = "failure"
+			}
+			f.metrics.DispatchTotal.WithLabelValues(label, status).Inc()
+			f.metrics.DispatchDuration.WithLabelValues(label).Observe(time.Since(attemptStart).Seconds())
+		}
+		if lastErr == nil {
+			return
+		}
+		if attempt == policy.MaxAttempts || !policy.shouldRetry(lastErr) {
+			break
+		}
+		f.Error().Str("target", t.Backend).Int("attempt", attempt).AnErr("error", lastErr).Msg("delivery failed, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+
+	f.Error().Str("target", t.Backend).AnErr("error", lastErr).Msg("delivery exhausted retries, sending to dead letter")
+	f.sendToDeadLetter(ctx, t, payload, lastErr)
+}
+
+// deadLetterEnvelope is what gets recorded for a message whose delivery to a
+// Target exhausted its retry policy.
+type deadLetterEnvelope struct {
+	Target  string          `json:"target"`
+	Error   string          `json:"error"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// deadLetterTarget returns the config to connect to t.DeadLetter with. When
+// the dead letter sink is the same broker as t.Backend, t's credentials
+// apply there too. Target has no separate credentials for a dead letter
+// sink on a different broker, so in that case connect without t's
+// credentials rather than silently reusing ones that belong elsewhere.
+func (f *distributer) deadLetterTarget(t Target, deadLetter *url.URL) Target {
+	if backend, err := url.Parse(t.Backend); err == nil && backend.Scheme == deadLetter.Scheme && backend.Host == deadLetter.Host {
+		return t
+	}
+	return Target{ID: t.ID, DeadLetter: t.DeadLetter}
+}
+
+func (f *distributer) sendToDeadLetter(ctx context.Context, t Target, payload []byte, cause error) {
+	if t.DeadLetter == "" {
+		return
+	}
+	env := deadLetterEnvelope{Target: t.Backend, Payload: payload}
+	if cause != nil {
+		env.Error = cause.Error()
+	}
+	js, err := json.Marshal(env)
+	if err != nil {
+		f.Error().AnErr("error", err).Msg("cannot marshal dead letter envelope")
+		return
+	}
+
+	u, err := url.Parse(t.DeadLetter)
+	if err != nil || u.Scheme == "" {
+		f.writeDeadLetterFile(t.DeadLetter, js)
+		return
+	}
+	p, err := f.publisherFor(u, f.deadLetterTarget(t, u))
+	if err != nil {
+		f.Error().Str("deadletter", t.DeadLetter).AnErr("error", err).Msg("cannot resolve dead letter publisher")
+		return
+	}
+	topic := t.ID
+	if topic == "" {
+		topic = "deadletter"
+	}
+	if err := p.Publish(ctx, topic, js, nil); err != nil {
+		f.Error().Str("deadletter", t.DeadLetter).AnErr("error", err).Msg("cannot deliver to dead letter sink")
+	}
+}
+
+func (f *distributer) writeDeadLetterFile(path string, js []byte) {
+	fh, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		f.Error().Str("file", path).AnErr("error", err).Msg("cannot open dead letter file")
+		return
+	}
+	defer fh.Close()
+	if _, err := fh.Write(append(js, '\n')); err != nil {
+		f.Error().Str("file", path).AnErr("error", err).Msg("cannot write dead letter file")
+	}
+}
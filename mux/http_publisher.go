@@ -0,0 +1,76 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	RegisterPublisherFactory("http", newHTTPPublisher)
+	RegisterPublisherFactory("https", newHTTPPublisher)
+}
+
+// httpPublisher preserves the original behavior of this package: it POSTs
+// the JSON payload to the Target's backend URL.
+type httpPublisher struct {
+	url    string
+	client *http.Client
+	log    zerolog.Logger
+}
+
+func newHTTPPublisher(backend *url.URL, t Target, log zerolog.Logger) (Publisher, error) {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: t.SkipTLS,
+		},
+	}
+	return &httpPublisher{url: backend.String(), client: &http.Client{Transport: tr}, log: log}, nil
+}
+
+func (p *httpPublisher) Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) error {
+	rq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("cannot create request: %v", err)
+	}
+	rq.Header.Add("Content-Type", "application/json")
+	for k, v := range headers {
+		rq.Header.Add(k, v)
+	}
+	rsp, err := p.client.Do(rq)
+	if err != nil {
+		return fmt.Errorf("cannot call webhook: %v", err)
+	}
+	defer rsp.Body.Close()
+	content, _ := io.ReadAll(rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return &httpStatusError{status: rsp.StatusCode, body: string(content), url: p.url}
+	}
+	p.log.Info().Str("target", p.url).Str("status", rsp.Status).Str("content", string(content)).Msg("data transmitted")
+	return nil
+}
+
+// httpStatusError records the backend's numeric status, so a RetryPolicy
+// keyed on status classes (e.g. RetryOn: []int{5} for 5xx) can inspect it.
+type httpStatusError struct {
+	status int
+	body   string
+	url    string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("webhook %q returned %d: %s", e.url, e.status, e.body)
+}
+
+func (e *httpStatusError) StatusCode() int { return e.status }
+
+func (p *httpPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
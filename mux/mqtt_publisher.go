@@ -0,0 +1,66 @@
+package mux
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	RegisterPublisherFactory("mqtt", newMQTTPublisher)
+}
+
+const mqttPublishTimeout = 10 * time.Second
+
+// mqttPublisher publishes to an MQTT topic, templated per Target (e.g.
+// "sbd/{imei}/data"). One client connection is shared by every Target that
+// points at the same broker with the same credentials and QoS (see
+// publisherKey).
+type mqttPublisher struct {
+	client mqtt.Client
+	qos    byte
+	log    zerolog.Logger
+}
+
+func newMQTTPublisher(backend *url.URL, t Target, log zerolog.Logger) (Publisher, error) {
+	opts := mqtt.NewClientOptions().AddBroker(backend.String())
+	if t.Username != "" {
+		opts.SetUsername(t.Username)
+		opts.SetPassword(t.Password)
+	}
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("cannot connect to mqtt broker %q: %v", backend, token.Error())
+	}
+	return &mqttPublisher{client: client, qos: t.QoS, log: log}, nil
+}
+
+func (p *mqttPublisher) Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) error {
+	token := p.client.Publish(topic, p.qos, false, payload)
+	done := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("cannot publish to topic %q: %v", topic, err)
+		}
+		p.log.Info().Str("topic", topic).Msg("data transmitted")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(mqttPublishTimeout):
+		return fmt.Errorf("timeout publishing to topic %q", topic)
+	}
+}
+
+func (p *mqttPublisher) Close() error {
+	p.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,55 @@
+package mux
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	RegisterPublisherFactory("nats", newNATSPublisher)
+}
+
+// natsPublisher publishes to a NATS subject. One connection is shared by
+// every Target that points at the same broker with the same credentials
+// (see publisherKey); the subject is derived per
+// message from the Target's topic template (see topicFor).
+type natsPublisher struct {
+	conn *nats.Conn
+	log  zerolog.Logger
+}
+
+func newNATSPublisher(backend *url.URL, t Target, log zerolog.Logger) (Publisher, error) {
+	var opts []nats.Option
+	if t.Username != "" {
+		opts = append(opts, nats.UserInfo(t.Username, t.Password))
+	}
+	conn, err := nats.Connect(backend.String(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to nats broker %q: %v", backend, err)
+	}
+	return &natsPublisher{conn: conn, log: log}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) error {
+	msg := &nats.Msg{Subject: topic, Data: payload}
+	for k, v := range headers {
+		if msg.Header == nil {
+			msg.Header = nats.Header{}
+		}
+		msg.Header.Set(k, v)
+	}
+	if err := p.conn.PublishMsg(msg); err != nil {
+		return fmt.Errorf("cannot publish to subject %q: %v", topic, err)
+	}
+	p.log.Info().Str("subject", topic).Msg("data transmitted")
+	return nil
+}
+
+func (p *natsPublisher) Close() error {
+	p.conn.Close()
+	return nil
+}
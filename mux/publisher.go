@@ -0,0 +1,67 @@
+package mux
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/SnapITHD/Pinpoint-DirectIP/sbd"
+)
+
+// A Publisher delivers an already-encoded payload to a single backend. A
+// Publisher is shared by every Target that resolves to the same publisher
+// key (see publisherKey: scheme, host, the path for http/https, and the
+// connection settings), so implementations must be safe for concurrent use.
+type Publisher interface {
+	// Publish delivers payload under topic. topic is the rendered
+	// subject/topic for backends that use one (NATS, MQTT); HTTP
+	// publishers ignore it and post to their configured backend URL.
+	Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) error
+	// Close releases the underlying broker connection.
+	Close() error
+}
+
+// A PublisherFactory builds a Publisher for a Target whose Backend URL has
+// been parsed into backend. Factories are looked up by backend.Scheme.
+type PublisherFactory func(backend *url.URL, t Target, log zerolog.Logger) (Publisher, error)
+
+var publisherFactories = map[string]PublisherFactory{}
+
+// RegisterPublisherFactory registers a PublisherFactory for the given URL
+// scheme, overriding any existing factory for that scheme. Built-in schemes
+// are "http", "https", "nats" and "mqtt"; register your own to support
+// additional backends (e.g. "kafka") without modifying this package.
+func RegisterPublisherFactory(scheme string, f PublisherFactory) {
+	publisherFactories[scheme] = f
+}
+
+func publisherFactoryFor(scheme string) (PublisherFactory, error) {
+	f, ok := publisherFactories[scheme]
+	if !ok {
+		return nil, fmt.Errorf("no publisher registered for backend scheme %q", scheme)
+	}
+	return f, nil
+}
+
+// topicFor renders the Target's topic/subject template, falling back to the
+// Target ID and then the IMEI when no template is configured. Templates may
+// reference {imei}, {momsn} and {cdrRef}.
+func topicFor(t Target, data *sbd.InformationBucket, imei string) string {
+	tmpl := t.Topic
+	if tmpl == "" {
+		tmpl = t.ID
+	}
+	if tmpl == "" {
+		tmpl = "{imei}"
+	}
+	r := strings.NewReplacer(
+		"{imei}", imei,
+		"{momsn}", strconv.Itoa(int(data.Header.GetMOMSN())),
+		"{cdrRef}", strconv.FormatUint(uint64(data.Header.GetCDRReference()), 10),
+	)
+	return r.Replace(tmpl)
+}
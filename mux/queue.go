@@ -0,0 +1,217 @@
+package mux
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/SnapITHD/Pinpoint-DirectIP/metrics"
+	"github.com/SnapITHD/Pinpoint-DirectIP/sbd"
+)
+
+// QueueOptions configures a Queue.
+type QueueOptions struct {
+	// Size bounds the number of messages buffered in memory. Defaults to
+	// 1000 when zero or negative.
+	Size int
+	// SpillDir persists messages that overflow the in-memory buffer, so a
+	// sustained backend outage degrades to disk instead of blocking
+	// message acknowledgement or growing memory without bound. If empty,
+	// Enqueue returns an error for a message that does not fit.
+	SpillDir string
+	// Metrics, if set, reports mux_queue_depth for the in-memory buffer.
+	Metrics *metrics.Collectors
+}
+
+// A queuedMessage is a durable unit of work: an incoming SBD message
+// together with the targets that matched it when it was enqueued.
+type queuedMessage struct {
+	Data    sbd.InformationBucket `json:"data"`
+	Targets []Target              `json:"targets"`
+}
+
+// Queue is a bounded, durable queue of messages pending delivery to their
+// targets. It decouples message acknowledgement from delivery: once Enqueue
+// returns, the message is durably held - in memory, or on disk once the
+// in-memory buffer is full - and will eventually be drained to its targets,
+// even across a slow or flapping backend.
+type Queue struct {
+	log      zerolog.Logger
+	ch       chan *queuedMessage
+	dir      string
+	seq      uint64
+	metrics  *metrics.Collectors
+	inFlight int64
+}
+
+// NewQueue creates a Queue. Call Drain to start delivering queued messages.
+func NewQueue(log zerolog.Logger, opts QueueOptions) (*Queue, error) {
+	size := opts.Size
+	if size <= 0 {
+		size = 1000
+	}
+	if opts.SpillDir != "" {
+		if err := os.MkdirAll(opts.SpillDir, 0o755); err != nil {
+			return nil, fmt.Errorf("cannot create spill directory %q: %v", opts.SpillDir, err)
+		}
+	}
+	return &Queue{log: log, ch: make(chan *queuedMessage, size), dir: opts.SpillDir, metrics: opts.Metrics}, nil
+}
+
+// Enqueue durably holds data for later delivery to targets. It never blocks:
+// once the in-memory buffer is full, the message is spilled to disk, or,
+// when no SpillDir is configured, Enqueue returns an error.
+func (q *Queue) Enqueue(data *sbd.InformationBucket, targets []Target) error {
+	m := &queuedMessage{Data: *data, Targets: targets}
+	select {
+	case q.ch <- m:
+		if q.metrics != nil {
+			q.metrics.QueueDepth.Inc()
+		}
+		return nil
+	default:
+	}
+	return q.spill(m)
+}
+
+func (q *Queue) spill(m *queuedMessage) error {
+	if q.dir == "" {
+		return fmt.Errorf("queue is full and no spill directory is configured")
+	}
+	js, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("cannot marshal spilled message: %v", err)
+	}
+	// The timestamp keeps names unique and ordered across restarts, where
+	// seq starts over, so files left by a previous run are not overwritten.
+	name := filepath.Join(q.dir, fmt.Sprintf("%020d-%020d.json", time.Now().UnixNano(), atomic.AddUint64(&q.seq, 1)))
+	if err := os.WriteFile(name, js, 0o644); err != nil {
+		return fmt.Errorf("cannot write spilled message %q: %v", name, err)
+	}
+	q.log.Warn().Str("file", name).Msg("delivery queue full, spilled message to disk")
+	return nil
+}
+
+// Drain starts workers consuming queued messages and calling deliver for
+// each. It also, when a SpillDir is configured, periodically moves spilled
+// files back into the in-memory buffer as room frees up - which also
+// recovers messages spilled by a previous run. Drain returns immediately;
+// workers stop when ctx is done.
+func (q *Queue) Drain(ctx context.Context, workers int, deliver func(context.Context, *queuedMessage)) {
+	if workers <= 0 {
+		workers = 1
+	}
+	if q.dir != "" {
+		go q.watchSpill(ctx)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m := <-q.ch:
+					if q.metrics != nil {
+						q.metrics.QueueDepth.Dec()
+					}
+					atomic.AddInt64(&q.inFlight, 1)
+					deliver(ctx, m)
+					atomic.AddInt64(&q.inFlight, -1)
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until the queue has no messages buffered in memory or spilled
+// to disk and no delivery is in flight, or until ctx is done - whichever
+// comes first. Call it before cancelling the context passed to Drain, so a
+// graceful shutdown flushes whatever was already durably enqueued instead of
+// abandoning it.
+func (q *Queue) Wait(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if len(q.ch) == 0 && atomic.LoadInt64(&q.inFlight) == 0 && q.spillEmpty() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) spillEmpty() bool {
+	if q.dir == "" {
+		return true
+	}
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		q.log.Error().Str("dir", q.dir).AnErr("error", err).Msg("cannot read spill directory")
+		return true
+	}
+	return len(entries) == 0
+}
+
+func (q *Queue) watchSpill(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.reloadSpill()
+		}
+	}
+}
+
+// reloadSpill moves spilled files, oldest first, back into the in-memory
+// buffer until it fills up again.
+func (q *Queue) reloadSpill() {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		q.log.Error().Str("dir", q.dir).AnErr("error", err).Msg("cannot read spill directory")
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(q.dir, name)
+		js, err := os.ReadFile(path)
+		if err != nil {
+			q.log.Error().Str("file", path).AnErr("error", err).Msg("cannot read spilled message")
+			continue
+		}
+		var m queuedMessage
+		if err := json.Unmarshal(js, &m); err != nil {
+			q.log.Error().Str("file", path).AnErr("error", err).Msg("cannot unmarshal spilled message, dropping")
+			os.Remove(path)
+			continue
+		}
+		select {
+		case q.ch <- &m:
+			if q.metrics != nil {
+				q.metrics.QueueDepth.Inc()
+			}
+			os.Remove(path)
+		default:
+			return // buffer is still full, try again next tick
+		}
+	}
+}
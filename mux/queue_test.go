@@ -0,0 +1,166 @@
+package mux
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/SnapITHD/Pinpoint-DirectIP/sbd"
+)
+
+func TestQueueEnqueueDrainsInOrder(t *testing.T) {
+	q, err := NewQueue(zerolog.Nop(), QueueOptions{Size: 10})
+	if err != nil {
+		t.Fatalf("NewQueue() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var delivered []int
+	for i := 0; i < 5; i++ {
+		if err := q.Enqueue(&sbd.InformationBucket{}, []Target{{ID: string(rune('a' + i))}}); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Drain(ctx, 1, func(_ context.Context, m *queuedMessage) {
+		mu.Lock()
+		delivered = append(delivered, int(m.Targets[0].ID[0]-'a'))
+		mu.Unlock()
+	})
+
+	q.Wait(ctx)
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 5 {
+		t.Fatalf("delivered %d messages, want 5", len(delivered))
+	}
+	for i, v := range delivered {
+		if v != i {
+			t.Errorf("delivered[%d] = %d, want %d (messages must drain FIFO)", i, v, i)
+		}
+	}
+}
+
+func TestQueueSpillsWhenFull(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(zerolog.Nop(), QueueOptions{Size: 1, SpillDir: dir})
+	if err != nil {
+		t.Fatalf("NewQueue() error = %v", err)
+	}
+
+	if err := q.Enqueue(&sbd.InformationBucket{}, nil); err != nil {
+		t.Fatalf("first Enqueue() error = %v", err)
+	}
+	if err := q.Enqueue(&sbd.InformationBucket{}, []Target{{ID: "overflow"}}); err != nil {
+		t.Fatalf("second Enqueue() error = %v, want nil (should spill to disk)", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("spill directory has %d files, want 1", len(entries))
+	}
+}
+
+func TestQueueEnqueueWithoutSpillDirErrorsWhenFull(t *testing.T) {
+	q, err := NewQueue(zerolog.Nop(), QueueOptions{Size: 1})
+	if err != nil {
+		t.Fatalf("NewQueue() error = %v", err)
+	}
+	if err := q.Enqueue(&sbd.InformationBucket{}, nil); err != nil {
+		t.Fatalf("first Enqueue() error = %v", err)
+	}
+	if err := q.Enqueue(&sbd.InformationBucket{}, nil); err == nil {
+		t.Fatal("second Enqueue() error = nil, want an error (buffer full, no spill dir)")
+	}
+}
+
+func TestQueueReloadSpillRestoresMessages(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(zerolog.Nop(), QueueOptions{Size: 1, SpillDir: dir})
+	if err != nil {
+		t.Fatalf("NewQueue() error = %v", err)
+	}
+
+	if err := q.Enqueue(&sbd.InformationBucket{}, []Target{{ID: "first"}}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if err := q.Enqueue(&sbd.InformationBucket{}, []Target{{ID: "spilled"}}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	var delivered []string
+	var mu sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Drain(ctx, 1, func(_ context.Context, m *queuedMessage) {
+		mu.Lock()
+		delivered = append(delivered, m.Targets[0].ID)
+		mu.Unlock()
+	})
+
+	deadline := time.After(2 * time.Second)
+	for {
+		q.reloadSpill()
+		mu.Lock()
+		n := len(delivered)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("delivered %d messages before timeout, want 2", n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if !q.spillEmpty() {
+		t.Error("spill directory should be empty after reload, but is not")
+	}
+}
+
+func TestQueueWaitReturnsOnlyOnceDrained(t *testing.T) {
+	q, err := NewQueue(zerolog.Nop(), QueueOptions{Size: 10})
+	if err != nil {
+		t.Fatalf("NewQueue() error = %v", err)
+	}
+	if err := q.Enqueue(&sbd.InformationBucket{}, nil); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Drain(ctx, 1, func(_ context.Context, _ *queuedMessage) {
+		<-release
+	})
+
+	waitDone := make(chan struct{})
+	go func() {
+		q.Wait(context.Background())
+		close(waitDone)
+	}()
+
+	select {
+	case <-waitDone:
+		t.Fatal("Wait() returned before the in-flight delivery finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-waitDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait() did not return after the in-flight delivery finished")
+	}
+}
@@ -0,0 +1,73 @@
+package mux
+
+import (
+	"errors"
+	"time"
+)
+
+// RetryPolicy configures how a failed delivery to a Target is retried before
+// the message is handed to its DeadLetter sink.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of delivery attempts, including the
+	// first one. Defaults to 1 (no retry) when zero.
+	MaxAttempts int `yaml:"maxattempts,omitempty"`
+	// InitialBackoff is the delay before the second attempt. Defaults to
+	// 1s when zero.
+	InitialBackoff time.Duration `yaml:"initialbackoff,omitempty"`
+	// MaxBackoff caps the delay between attempts. Defaults to 30s when
+	// zero.
+	MaxBackoff time.Duration `yaml:"maxbackoff,omitempty"`
+	// Multiplier grows the backoff after each failed attempt. Defaults to
+	// 2 when zero.
+	Multiplier float64 `yaml:"multiplier,omitempty"`
+	// RetryOn lists the HTTP status classes worth retrying, e.g. []int{5}
+	// retries only 5xx responses. Errors with no status (transport
+	// failures, timeouts) are always retried. An empty RetryOn retries
+	// every failure, regardless of status.
+	RetryOn []int `yaml:"retryon,omitempty"`
+	// Timeout bounds a single delivery attempt. Zero means no per-attempt
+	// timeout beyond the context passed to Publish.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// withDefaults returns a copy of p with zero-valued fields replaced by their
+// defaults.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 1
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	if p.Multiplier <= 0 {
+		p.Multiplier = 2
+	}
+	return p
+}
+
+// statusCoder is implemented by Publisher errors that carry a backend status
+// code, such as the one httpPublisher returns for non-2xx responses.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// shouldRetry reports whether a failed attempt is worth retrying under p.
+func (p RetryPolicy) shouldRetry(err error) bool {
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	var sc statusCoder
+	if !errors.As(err, &sc) {
+		return true
+	}
+	class := sc.StatusCode() / 100
+	for _, c := range p.RetryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
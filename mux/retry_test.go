@@ -0,0 +1,57 @@
+package mux
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	p := RetryPolicy{}.withDefaults()
+	if p.MaxAttempts != 1 {
+		t.Errorf("MaxAttempts = %d, want 1", p.MaxAttempts)
+	}
+	if p.InitialBackoff != time.Second {
+		t.Errorf("InitialBackoff = %v, want %v", p.InitialBackoff, time.Second)
+	}
+	if p.MaxBackoff != 30*time.Second {
+		t.Errorf("MaxBackoff = %v, want %v", p.MaxBackoff, 30*time.Second)
+	}
+	if p.Multiplier != 2 {
+		t.Errorf("Multiplier = %v, want 2", p.Multiplier)
+	}
+
+	custom := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Minute, Multiplier: 1.5}.withDefaults()
+	if custom.MaxAttempts != 5 || custom.InitialBackoff != time.Millisecond || custom.MaxBackoff != time.Minute || custom.Multiplier != 1.5 {
+		t.Errorf("withDefaults changed already-set fields: %+v", custom)
+	}
+}
+
+type statusCodeError struct {
+	code int
+}
+
+func (e *statusCodeError) Error() string   { return "status error" }
+func (e *statusCodeError) StatusCode() int { return e.code }
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	cases := []struct {
+		name string
+		p    RetryPolicy
+		err  error
+		want bool
+	}{
+		{"empty RetryOn retries anything", RetryPolicy{}, errors.New("boom"), true},
+		{"no status code always retries", RetryPolicy{RetryOn: []int{5}}, errors.New("transport error"), true},
+		{"matching status class retries", RetryPolicy{RetryOn: []int{5}}, &statusCodeError{code: 503}, true},
+		{"non-matching status class does not retry", RetryPolicy{RetryOn: []int{5}}, &statusCodeError{code: 404}, false},
+		{"matches one of several classes", RetryPolicy{RetryOn: []int{4, 5}}, &statusCodeError{code: 429}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.p.shouldRetry(c.err); got != c.want {
+				t.Errorf("shouldRetry() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
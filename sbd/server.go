@@ -1,14 +1,23 @@
 package sbd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
+
+	"github.com/SnapITHD/Pinpoint-DirectIP/metrics"
 )
 
 const (
@@ -31,17 +40,132 @@ func (f HandlerFunc) Handle(data *InformationBucket) error {
 	return f(data)
 }
 
+// A ContextHandler is a Handler that also accepts the context the service is
+// running under. The service prefers HandleContext over Handle whenever a
+// Handler implements it, so shutdown deadlines and cancellation propagate all
+// the way into the handler instead of leaking goroutines when a shutdown
+// races an in-flight request.
+type ContextHandler interface {
+	HandleContext(ctx context.Context, data *InformationBucket) error
+}
+
+// callHandler dispatches to h.HandleContext when h implements ContextHandler,
+// falling back to the plain Handle otherwise.
+func callHandler(ctx context.Context, h Handler, data *InformationBucket) error {
+	if ch, ok := h.(ContextHandler); ok {
+		return ch.HandleContext(ctx, data)
+	}
+	return h.Handle(data)
+}
+
+type connInfoKey struct{}
+
+// ConnInfo carries the network addresses observed for an inbound connection.
+// RemoteAddr is the address the Service accepted the connection from (the
+// immediate peer, e.g. a load balancer doing PROXY protocol or TLS
+// termination). ProxiedFrom is the original client address as revealed by
+// the PROXY protocol header, when the peer is trusted and a header was
+// present; it is nil otherwise.
+type ConnInfo struct {
+	RemoteAddr  net.Addr
+	ProxiedFrom net.Addr
+	// PeerCertificate is the client certificate negotiated during the TLS
+	// handshake, when ServiceOptions.TLSConfig required one (mTLS). Nil
+	// when the connection is not TLS, or no client certificate was
+	// presented. Handlers can inspect its Subject.CommonName or DNSNames
+	// to authorize the connecting gateway.
+	PeerCertificate *x509.Certificate
+}
+
+// ContextWithConnInfo returns a copy of ctx carrying info. The Service
+// populates this automatically for every accepted connection before invoking
+// the Handler; middleware and handlers retrieve it with
+// ConnInfoFromContext.
+func ContextWithConnInfo(ctx context.Context, info ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// ConnInfoFromContext returns the ConnInfo the Service stored in ctx, if any.
+func ConnInfoFromContext(ctx context.Context) (ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(ConnInfo)
+	return info, ok
+}
+
 // Logger is a middleware function which wraps a handler with logging
 // capabilities.
 func Logger(log zerolog.Logger, next Handler) Handler {
-	return HandlerFunc(func(data *InformationBucket) error {
-		js, err := json.Marshal(data)
-		if err != nil {
-			return err
+	return loggingHandler{log: log, next: next}
+}
+
+type loggingHandler struct {
+	log  zerolog.Logger
+	next Handler
+}
+
+func (l loggingHandler) Handle(data *InformationBucket) error {
+	return l.HandleContext(context.Background(), data)
+}
+
+func (l loggingHandler) HandleContext(ctx context.Context, data *InformationBucket) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	ev := l.log.Info().Str("elements", string(js))
+	if info, ok := ConnInfoFromContext(ctx); ok {
+		if info.RemoteAddr != nil {
+			ev = ev.Str("remote_addr", info.RemoteAddr.String())
 		}
-		log.Info().Str("elements", string(js)).Msg("new data")
-		return next.Handle(data)
-	})
+		if info.ProxiedFrom != nil {
+			ev = ev.Str("proxied_from", info.ProxiedFrom.String())
+		}
+		if info.PeerCertificate != nil {
+			ev = ev.Str("peer_cert_cn", info.PeerCertificate.Subject.CommonName)
+		}
+	}
+	ev.Msg("new data")
+	return callHandler(ctx, l.next, data)
+}
+
+// Metrics is a middleware function which wraps a handler with Prometheus
+// instrumentation, recording sbd_messages_total (labeled by outcome and
+// IMEI class) and sbd_message_bytes. It mirrors the existing Logger
+// middleware, so the two compose freely, e.g.
+// sbd.Logger(log, sbd.Metrics(reg, next)).
+func Metrics(reg prometheus.Registerer, next Handler) Handler {
+	return &metricsHandler{
+		next: next,
+		messagesTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "sbd_messages_total",
+			Help: "Total number of SBD messages processed, by outcome and IMEI class.",
+		}, []string{"status", "imei_class"}),
+		messageBytes: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "sbd_message_bytes",
+			Help:    "Size of decoded SBD message payloads in bytes.",
+			Buckets: prometheus.ExponentialBuckets(32, 2, 10),
+		}),
+	}
+}
+
+type metricsHandler struct {
+	next          Handler
+	messagesTotal *prometheus.CounterVec
+	messageBytes  prometheus.Histogram
+}
+
+func (m *metricsHandler) Handle(data *InformationBucket) error {
+	return m.HandleContext(context.Background(), data)
+}
+
+func (m *metricsHandler) HandleContext(ctx context.Context, data *InformationBucket) error {
+	m.messageBytes.Observe(float64(len(data.Payload)))
+	err := callHandler(ctx, m.next, data)
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+	m.messagesTotal.WithLabelValues(status, metrics.IMEIClass(data.Header.GetIMEI())).Inc()
+	return err
 }
 
 type result struct {
@@ -54,53 +178,223 @@ func createResult(status byte) *result {
 	return &result{MessageHeader: MessageHeader{ProtocolRevision: protocolRevision, MessageLength: 4}, Header: Header{ID: moConfirmationID, ElementLength: 1}, MOConfirmationMessage: MOConfirmationMessage{Status: status}}
 }
 
-// NewService starts a listener on the given *address* and dispatches every
-// short burst data packet to the given handler. If the handler returns a
-// non-nil error, the service will send a negative response, otherwise the
-// response status will be ok.
-func NewService(log zerolog.Logger, address string, h Handler, proxyprotocol bool) error {
-	l, err := net.Listen("tcp", address)
+// ServiceOptions configures optional behavior of a Service.
+type ServiceOptions struct {
+	// ProxyProtocol accepts a PROXY protocol header on new connections, as
+	// used by some L4 load balancers, before reading the SBD payload.
+	ProxyProtocol bool
+	// ShutdownTimeout bounds how long Shutdown waits for in-flight
+	// connections to finish before giving up. Zero means wait forever (or
+	// until the context passed to Shutdown is done).
+	ShutdownTimeout time.Duration
+	// TrustedProxies restricts which peers are allowed to present a PROXY
+	// protocol header. When ProxyProtocol is enabled and TrustedProxies is
+	// non-empty, the header is only honored for connections whose
+	// immediate peer address falls within one of these networks; for any
+	// other peer the header is ignored and conn.RemoteAddr() is used as
+	// is. An empty TrustedProxies honors the header from any peer.
+	TrustedProxies []net.IPNet
+	// Metrics, if set, records connection-level Prometheus metrics:
+	// sbd_connections_total, sbd_connection_duration_seconds and
+	// sbd_decode_errors_total. Use the Metrics middleware in addition to
+	// instrument the Handler with per-message metrics.
+	Metrics *metrics.Collectors
+	// TLSConfig, if set, terminates TLS on every accepted connection,
+	// after any PROXY protocol header has been consumed, instead of
+	// requiring an external terminator. Set TLSConfig.ClientAuth (e.g.
+	// tls.RequireAndVerifyClientCert) and TLSConfig.ClientCAs to require
+	// mTLS from the Iridium gateway or another trusted front-end; the
+	// negotiated peer certificate is then available from ConnInfo.
+	TLSConfig *tls.Config
+}
+
+// A Service listens on a TCP address and dispatches every short burst data
+// packet it receives to a Handler. If the handler returns a non-nil error,
+// the service sends a negative acknowledgement, otherwise the response
+// status is ok.
+//
+// Use New to create a Service, Run to start serving and Shutdown to stop
+// accepting new connections and drain in-flight ones.
+type Service struct {
+	log     zerolog.Logger
+	address string
+	handler Handler
+	opts    ServiceOptions
+
+	mu       sync.Mutex
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// New creates a Service listening on address and dispatching to h. Call Run
+// to start serving.
+func New(log zerolog.Logger, address string, h Handler, opts ServiceOptions) *Service {
+	return &Service{log: log, address: address, handler: h, opts: opts}
+}
+
+// Run opens the listening socket and serves connections until ctx is
+// cancelled or an unrecoverable accept error occurs. Run returns nil once the
+// listener has been closed as part of a shutdown; any other accept error is
+// returned to the caller. The listener is always closed before Run returns,
+// on every path, regardless of which caused it to stop.
+func (s *Service) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.address)
 	if err != nil {
-		return fmt.Errorf("cannot open listening address %q: %v", address, err)
+		return fmt.Errorf("cannot open listening address %q: %v", s.address, err)
 	}
-	if proxyprotocol {
-		l = &proxyproto.Listener{Listener: l, ReadHeaderTimeout: 10 * time.Second}
+	if s.opts.ProxyProtocol {
+		l = &proxyproto.Listener{
+			Listener:          l,
+			ReadHeaderTimeout: 10 * time.Second,
+			Policy:            trustedProxyPolicy(s.opts.TrustedProxies),
+		}
 	}
+
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
 	defer l.Close()
+
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-closed:
+		}
+	}()
+
 	for {
-		// Wait for a connection.
 		conn, err := l.Accept()
 		if err != nil {
-			log.Fatal().AnErr("error", err).Msg("cannot accept")
-			// let it crash! it's up to the caller of the program to restart it
-			panic(err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("cannot accept on %q: %v", s.address, err)
 		}
 
+		s.wg.Add(1)
 		go func(c net.Conn) {
-			// directip connects, sends message and closes connection, so no while loop is needed
-			// to read more than one message from the connection
-			defer c.Close()
-
-			// set a deadline so we do not run out of connections
-			c.SetDeadline(time.Now().Add(deadline))
-
-			log.Info().Msg("new connection")
-			el, err := GetElements(c)
-			res := createResult(0)
-			if err != nil {
-				log.Error().AnErr("error", err).Msg("cannot get elements from connection")
-				binary.Write(c, binary.BigEndian, res)
-				return
-			}
-			log.Info().Any("elements", el).Msg("received data")
-			err = h.Handle(el)
-			if err != nil {
-				log.Error().AnErr("error", err).Msg("error handling message")
-			} else {
-				res.Status = 1
-			}
-			log.Info().Any("result", res).Msg("write response")
-			binary.Write(c, binary.BigEndian, res)
+			defer s.wg.Done()
+			s.handle(ctx, c)
 		}(conn)
 	}
 }
+
+// Shutdown stops accepting new connections and waits for in-flight handlers
+// to finish, up to the Service's ShutdownTimeout or until ctx is done,
+// whichever comes first.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	l := s.listener
+	s.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+
+	if s.opts.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.ShutdownTimeout)
+		defer cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Service) handle(ctx context.Context, c net.Conn) {
+	// directip connects, sends message and closes connection, so no while loop is needed
+	// to read more than one message from the connection
+	defer c.Close()
+
+	// set a deadline so we do not run out of connections
+	c.SetDeadline(time.Now().Add(deadline))
+
+	start := time.Now()
+	if s.opts.Metrics != nil {
+		s.opts.Metrics.ConnectionsTotal.Inc()
+		defer func() {
+			s.opts.Metrics.ConnectionDuration.Observe(time.Since(start).Seconds())
+		}()
+	}
+
+	info := ConnInfo{RemoteAddr: c.RemoteAddr()}
+	if pc, ok := c.(*proxyproto.Conn); ok {
+		info.RemoteAddr = pc.Raw().RemoteAddr()
+		if pc.ProxyHeader() != nil {
+			info.ProxiedFrom = pc.RemoteAddr()
+		}
+	}
+
+	if s.opts.TLSConfig != nil {
+		tlsConn := tls.Server(c, s.opts.TLSConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			s.log.Error().AnErr("error", err).Msg("TLS handshake failed")
+			return
+		}
+		defer tlsConn.Close()
+		c = tlsConn
+		if state := tlsConn.ConnectionState(); len(state.PeerCertificates) > 0 {
+			info.PeerCertificate = state.PeerCertificates[0]
+		}
+	}
+
+	ctx = ContextWithConnInfo(ctx, info)
+
+	s.log.Info().Stringer("remote", info.RemoteAddr).Msg("new connection")
+	el, err := GetElements(c)
+	res := createResult(0)
+	if err != nil {
+		s.log.Error().AnErr("error", err).Msg("cannot get elements from connection")
+		if s.opts.Metrics != nil {
+			s.opts.Metrics.DecodeErrorsTotal.Inc()
+		}
+		binary.Write(c, binary.BigEndian, res)
+		return
+	}
+	s.log.Info().Any("elements", el).Msg("received data")
+	err = callHandler(ctx, s.handler, el)
+	if err != nil {
+		s.log.Error().AnErr("error", err).Msg("error handling message")
+	} else {
+		res.Status = 1
+	}
+	s.log.Info().Any("result", res).Msg("write response")
+	binary.Write(c, binary.BigEndian, res)
+}
+
+// trustedProxyPolicy builds a proxyproto.PolicyFunc that only honors the
+// PROXY protocol header for peers within trusted. An empty trusted list
+// honors the header unconditionally.
+func trustedProxyPolicy(trusted []net.IPNet) proxyproto.PolicyFunc {
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		if len(trusted) == 0 {
+			return proxyproto.USE, nil
+		}
+		host, _, err := net.SplitHostPort(upstream.String())
+		if err != nil {
+			host = upstream.String()
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return proxyproto.SKIP, nil
+		}
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return proxyproto.USE, nil
+			}
+		}
+		return proxyproto.SKIP, nil
+	}
+}